@@ -17,12 +17,8 @@ limitations under the License.
 package main
 
 import (
-	"crypto/tls"
-	"crypto/x509"
 	"flag"
 	"fmt"
-	"io/ioutil"
-	"log"
 	"net/http"
 	"net/url"
 	"os"
@@ -55,37 +51,87 @@ type PrometheusAdapter struct {
 	PrometheusAuthConf string
 	// PrometheusCAFile points to the file containing the ca-root for connecting with Prometheus
 	PrometheusCAFile string
+	// PrometheusClientCertFile points to the client certificate used for mTLS with Prometheus
+	PrometheusClientCertFile string
+	// PrometheusClientKeyFile points to the client key used for mTLS with Prometheus
+	PrometheusClientKeyFile string
+	// PrometheusTLSReloadInterval is how often the CA/client-cert/client-key files are re-read from disk
+	PrometheusTLSReloadInterval time.Duration
+	// PrometheusTokenFile points to a file containing a bearer token to present to Prometheus
+	PrometheusTokenFile string
+	// PrometheusTokenReloadInterval is how often PrometheusTokenFile is re-read from disk
+	PrometheusTokenReloadInterval time.Duration
+	// PrometheusInsecureSkipVerify disables TLS certificate verification when connecting to Prometheus
+	PrometheusInsecureSkipVerify bool
+	// PrometheusFederationConfigFile points to a YAML file describing multiple
+	// upstream Prometheus/Thanos/Cortex endpoints to federate queries across.
+	// When set, it takes precedence over PrometheusURL.
+	PrometheusFederationConfigFile string
 	// AdapterConfigFile points to the file containing the metrics discovery configuration.
 	AdapterConfigFile string
+	// ConfigReloadInterval is how often AdapterConfigFile is polled for changes and hot-reloaded.
+	// Zero disables polling; SIGHUP still forces a single reload.
+	ConfigReloadInterval time.Duration
 	// MetricsRelistInterval is the interval at which to relist the set of available metrics
 	MetricsRelistInterval time.Duration
+	// MetricsBindAddress is the address the adapter's own self-metrics are served on.
+	MetricsBindAddress string
+	// MetricsTLSCertFile and MetricsTLSKeyFile, if both set, serve self-metrics over TLS.
+	MetricsTLSCertFile string
+	MetricsTLSKeyFile  string
+	// MetricsClientCAFile, if set, requires and verifies a client certificate when scraping self-metrics.
+	MetricsClientCAFile string
+	// MetricsBackendName selects which MetricsBackend implementation answers discovery-config queries.
+	MetricsBackendName string
+	// ThanosPartialResponse and ThanosDedup configure the "thanos" metrics backend.
+	ThanosPartialResponse bool
+	ThanosDedup           bool
+	// VictoriaMetricsExtraFilters configures extra_filters[] for the "victoriametrics" metrics backend.
+	VictoriaMetricsExtraFilters []string
+	// MetricsGRPCAddress configures the "grpc" metrics backend.
+	MetricsGRPCAddress string
+	// DisableOpenAPI drops requests for the apiserver's /openapi and /swagger routes.
+	DisableOpenAPI bool
+	// DisableProfiling drops requests for every apiserver route under /debug, including /debug/pprof.
+	DisableProfiling bool
+	// AllowedURLPrefixes, if non-empty, restricts the apiserver to serving only
+	// paths under one of these prefixes. Empty by default (opt-in), matching
+	// DisableOpenAPI/DisableProfiling: upgrading without setting any of these
+	// three flags must not change what the apiserver already serves.
+	AllowedURLPrefixes []string
+	// PrometheusStartupTimeout bounds how long the startup Prometheus reachability probe retries
+	// before the adapter fails fast. Zero means retry forever.
+	PrometheusStartupTimeout time.Duration
 
 	metricsConfig *adaptercfg.MetricsDiscoveryConfig
 }
 
-func (cmd *PrometheusAdapter) makePromClient() (prom.Client, error) {
+func (cmd *PrometheusAdapter) makePromClient(stopCh <-chan struct{}) (prom.Client, error) {
+	if cmd.PrometheusFederationConfigFile != "" {
+		fedConfig, err := loadFederatedEndpointsConfig(cmd.PrometheusFederationConfigFile)
+		if err != nil {
+			return nil, err
+		}
+		return NewFederatedClient(fedConfig, func(ep PrometheusEndpoint) (http.RoundTripper, error) {
+			return cmd.buildPrometheusTransportWithOverrides(stopCh,
+				firstNonEmpty(ep.CAFile, cmd.PrometheusCAFile),
+				firstNonEmpty(ep.ClientCertFile, cmd.PrometheusClientCertFile),
+				firstNonEmpty(ep.ClientKeyFile, cmd.PrometheusClientKeyFile),
+				ep.InsecureSkipVerify || cmd.PrometheusInsecureSkipVerify,
+				firstNonEmpty(ep.TokenFile, cmd.PrometheusTokenFile))
+		})
+	}
+
 	baseURL, err := url.Parse(cmd.PrometheusURL)
 	if err != nil {
 		return nil, fmt.Errorf("invalid Prometheus URL %q: %v", baseURL, err)
 	}
 
-	var httpClient *http.Client
-
-	if cmd.PrometheusCAFile != "" {
-		prometheusCAClient, err := makePrometheusCAClient(cmd.PrometheusCAFile)
-		if err != nil {
-			return nil, err
-		}
-		httpClient = prometheusCAClient
-		fmt.Println("successfully loaded ca file")
-	} else {
-		kubeconfigHTTPClient, err := makeKubeconfigHTTPClient(cmd.PrometheusAuthInCluster, cmd.PrometheusAuthConf)
-		if err != nil {
-			return nil, err
-		}
-		httpClient = kubeconfigHTTPClient
-		fmt.Println("successfully using in cluster")
+	transport, err := cmd.buildPrometheusTransport(stopCh)
+	if err != nil {
+		return nil, err
 	}
+	httpClient := &http.Client{Transport: transport}
 
 	genericPromClient := prom.NewGenericAPIClient(httpClient, baseURL)
 	instrumentedGenericPromClient := mprom.InstrumentGenericAPIClient(genericPromClient, baseURL.String())
@@ -101,14 +147,64 @@ func (cmd *PrometheusAdapter) addFlags() {
 		"kubeconfig file used to configure auth when connecting to Prometheus.")
 	cmd.Flags().StringVar(&cmd.PrometheusCAFile, "prometheus-ca-file", cmd.PrometheusCAFile,
 		"Optional CA file to use when connecting with Prometheus")
+	cmd.Flags().StringVar(&cmd.PrometheusClientCertFile, "prometheus-client-cert", cmd.PrometheusClientCertFile,
+		"Optional client certificate file to use for mTLS when connecting with Prometheus")
+	cmd.Flags().StringVar(&cmd.PrometheusClientKeyFile, "prometheus-client-key", cmd.PrometheusClientKeyFile,
+		"Optional client key file to use for mTLS when connecting with Prometheus")
+	cmd.Flags().DurationVar(&cmd.PrometheusTLSReloadInterval, "prometheus-tls-reload-interval", cmd.PrometheusTLSReloadInterval,
+		"interval at which to re-read the Prometheus CA/client-cert/client-key files from disk, to pick up rotated secrets")
+	cmd.Flags().StringVar(&cmd.PrometheusTokenFile, "prometheus-token-file", cmd.PrometheusTokenFile,
+		"Optional file containing a bearer token to present when connecting with Prometheus")
+	cmd.Flags().DurationVar(&cmd.PrometheusTokenReloadInterval, "prometheus-token-reload-interval", cmd.PrometheusTokenReloadInterval,
+		"interval at which to re-read prometheus-token-file from disk, to pick up rotated secrets")
+	cmd.Flags().BoolVar(&cmd.PrometheusInsecureSkipVerify, "prometheus-insecure-skip-verify", cmd.PrometheusInsecureSkipVerify,
+		"skip verification of the Prometheus server's TLS certificate. Use with caution.")
+	cmd.Flags().StringVar(&cmd.PrometheusFederationConfigFile, "prometheus-federation-config", cmd.PrometheusFederationConfigFile,
+		"YAML file describing multiple upstream Prometheus/Thanos/Cortex endpoints to federate queries across. "+
+			"When set, takes precedence over --prometheus-url.")
 	cmd.Flags().StringVar(&cmd.AdapterConfigFile, "config", cmd.AdapterConfigFile,
 		"Configuration file containing details of how to transform between Prometheus metrics "+
 			"and custom metrics API resources")
 	cmd.Flags().DurationVar(&cmd.MetricsRelistInterval, "metrics-relist-interval", cmd.MetricsRelistInterval, ""+
 		"interval at which to re-list the set of all available metrics from Prometheus")
+	cmd.Flags().DurationVar(&cmd.ConfigReloadInterval, "config-reload-interval", cmd.ConfigReloadInterval,
+		"interval at which to check --config's mtime for changes and hot-reload the discovery configuration; "+
+			"0 disables polling and leaves SIGHUP as the only way to reload")
+	cmd.Flags().StringVar(&cmd.MetricsBindAddress, "metrics-bind-address", cmd.MetricsBindAddress,
+		"address to serve the adapter's own Prometheus self-metrics on, separate from the aggregated apiserver")
+	cmd.Flags().StringVar(&cmd.MetricsTLSCertFile, "metrics-tls-cert-file", cmd.MetricsTLSCertFile,
+		"certificate file to serve self-metrics over TLS; requires metrics-tls-key-file")
+	cmd.Flags().StringVar(&cmd.MetricsTLSKeyFile, "metrics-tls-key-file", cmd.MetricsTLSKeyFile,
+		"key file to serve self-metrics over TLS; requires metrics-tls-cert-file")
+	cmd.Flags().StringVar(&cmd.MetricsClientCAFile, "metrics-client-ca-file", cmd.MetricsClientCAFile,
+		"CA file used to require and verify client certificates when scraping self-metrics")
+	cmd.Flags().StringVar(&cmd.MetricsBackendName, "metrics-backend", cmd.MetricsBackendName,
+		fmt.Sprintf("which metrics backend to query: %s, %s, %s, or %s (%s is not yet implemented; "+
+			"no PromQL-over-gRPC client is vendored, and setting it will fail at startup)",
+			backendPrometheus, backendThanos, backendVictoriaMetrics, backendGenericGRPC, backendGenericGRPC))
+	cmd.Flags().BoolVar(&cmd.ThanosPartialResponse, "thanos-partial-response", cmd.ThanosPartialResponse,
+		"value of the partial_response query parameter sent to a Thanos Query metrics backend")
+	cmd.Flags().BoolVar(&cmd.ThanosDedup, "thanos-dedup", cmd.ThanosDedup,
+		"value of the dedup query parameter sent to a Thanos Query metrics backend")
+	cmd.Flags().StringSliceVar(&cmd.VictoriaMetricsExtraFilters, "victoriametrics-extra-filter", cmd.VictoriaMetricsExtraFilters,
+		"extra_filters[] query parameter(s) sent to a VictoriaMetrics metrics backend; may be repeated")
+	cmd.Flags().StringVar(&cmd.MetricsGRPCAddress, "metrics-grpc-address", cmd.MetricsGRPCAddress,
+		"address of a PromQL-over-gRPC query service to use as the metrics backend "+
+			"(only meaningful with --metrics-backend=grpc, which is not yet implemented)")
+	cmd.Flags().BoolVar(&cmd.DisableOpenAPI, "disable-openapi", cmd.DisableOpenAPI,
+		"disable the /openapi and /swagger routes on the aggregated apiserver")
+	cmd.Flags().BoolVar(&cmd.DisableProfiling, "disable-profiling", cmd.DisableProfiling,
+		"disable the /debug routes (including /debug/pprof) on the aggregated apiserver")
+	cmd.Flags().StringSliceVar(&cmd.AllowedURLPrefixes, "allowed-url-prefix", cmd.AllowedURLPrefixes,
+		"if set, the apiserver only serves paths under one of these prefixes; all other paths 404. "+
+			"Empty by default, serving the apiserver's normal surface. May be repeated.")
+	cmd.Flags().DurationVar(&cmd.PrometheusStartupTimeout, "prometheus-startup-timeout", cmd.PrometheusStartupTimeout,
+		"how long to retry the startup Prometheus reachability probe before failing fast; 0 retries forever")
 }
 
 func (cmd *PrometheusAdapter) loadConfig() error {
+	start := time.Now()
+
 	// load metrics discovery configuration
 	if cmd.AdapterConfigFile == "" {
 		return fmt.Errorf("no metrics discovery configuration file specified (make sure to use --config)")
@@ -119,12 +215,21 @@ func (cmd *PrometheusAdapter) loadConfig() error {
 	}
 
 	cmd.metricsConfig = metricsConfig
+	discoveryDuration.Observe(time.Since(start).Seconds())
+	discoveryRuleCount.Set(float64(len(metricsConfig.Rules)))
 
 	return nil
 }
 
 func (cmd *PrometheusAdapter) makeProvider(promClient prom.Client, stopCh <-chan struct{}) (provider.CustomMetricsProvider, error) {
-	if len(cmd.metricsConfig.Rules) == 0 {
+	return cmd.makeProviderForConfig(cmd.metricsConfig, promClient, stopCh)
+}
+
+// makeProviderForConfig builds a custom metrics provider from an explicit
+// discovery config, rather than cmd.metricsConfig, so a hot-reload can build
+// and validate a replacement provider before swapping it in.
+func (cmd *PrometheusAdapter) makeProviderForConfig(metricsConfig *adaptercfg.MetricsDiscoveryConfig, promClient prom.Client, stopCh <-chan struct{}) (provider.CustomMetricsProvider, error) {
+	if len(metricsConfig.Rules) == 0 {
 		return nil, nil
 	}
 
@@ -139,7 +244,7 @@ func (cmd *PrometheusAdapter) makeProvider(promClient prom.Client, stopCh <-chan
 	}
 
 	// extract the namers
-	namers, err := cmprov.NamersFromConfig(cmd.metricsConfig, mapper)
+	namers, err := cmprov.NamersFromConfig(metricsConfig, mapper)
 	if err != nil {
 		return nil, fmt.Errorf("unable to construct naming scheme from metrics rules: %v", err)
 	}
@@ -194,34 +299,64 @@ func main() {
 
 	// set up flags
 	cmd := &PrometheusAdapter{
-		PrometheusURL:         "https://localhost",
-		MetricsRelistInterval: 10 * time.Minute,
+		PrometheusURL:                 "https://localhost",
+		MetricsRelistInterval:         10 * time.Minute,
+		PrometheusTLSReloadInterval:   5 * time.Minute,
+		PrometheusTokenReloadInterval: 5 * time.Minute,
+		MetricsBindAddress:            ":9090",
+		MetricsBackendName:            backendPrometheus,
+		ThanosPartialResponse:         true,
+		ThanosDedup:                   true,
+		ConfigReloadInterval:          30 * time.Second,
 	}
 	cmd.Name = "prometheus-metrics-adapter"
 	cmd.addFlags()
 	cmd.Flags().AddGoFlagSet(flag.CommandLine) // make sure we get the glog flags
 	cmd.Flags().Parse(os.Args)
 
-	// make the prometheus client
-	promClient, err := cmd.makePromClient()
+	readiness := &readinessGates{}
+
+	// make the metrics backend client
+	promClient, err := cmd.buildMetricsBackend(wait.NeverStop)
 	if err != nil {
-		glog.Fatalf("unable to construct Prometheus client: %v", err)
+		glog.Fatalf("unable to construct metrics backend client: %v", err)
 	}
+	go cmd.probePrometheusReachable(promClient, readiness)
 
 	// load the config
 	if err := cmd.loadConfig(); err != nil {
 		glog.Fatalf("unable to load metrics discovery config: %v", err)
 	}
+	readiness.markConfigLoaded()
+
+	// wrap the backend's Series calls (what the relist loop uses to discover
+	// metrics) so we can report how many series the most recent relist found,
+	// how often repeated calls are served from its short-lived cache, and --
+	// via onFirstSuccess -- learn the moment a relist cycle actually completes,
+	// rather than inferring it from the resulting metric count.
+	promClient = newRelistInstrumentedClient(promClient, relistCacheTTL(cmd.MetricsRelistInterval), readiness.markRelisted)
 
 	// construct the provider
-	cmProvider, err := cmd.makeProvider(promClient, wait.NeverStop)
+	initialBuildStop := make(chan struct{})
+	cmProvider, err := cmd.makeProvider(promClient, initialBuildStop)
 	if err != nil {
 		glog.Fatalf("unable to construct custom metrics provider: %v", err)
 	}
+	if cmProvider == nil {
+		// no custom metrics rules configured, so no relist loop will ever run
+		close(initialBuildStop)
+		readiness.markRelisted()
+	}
 
-	// attach the provider to the server, if it's needed
+	// wrap it in a reloading facade and attach the provider to the server, if it's needed
 	if cmProvider != nil {
-		cmd.WithCustomMetrics(cmProvider)
+		reloadingCMProvider := newReloadingProvider(cmProvider, initialBuildStop)
+		cmd.WithCustomMetrics(instrumentProvider(reloadingCMProvider))
+		go cmd.watchConfigReload(promClient, reloadingCMProvider, wait.NeverStop)
+	}
+
+	if err := cmd.registerReadyzChecks(readiness); err != nil {
+		glog.Fatalf("unable to register readiness checks: %v", err)
 	}
 
 	// attach resource metrics support, if it's needed
@@ -229,22 +364,43 @@ func main() {
 		glog.Fatalf("unable to install resource metrics API: %v", err)
 	}
 
+	// serve the adapter's own metrics on a dedicated listener
+	if err := cmd.serveSelfMetrics(wait.NeverStop); err != nil {
+		glog.Fatalf("unable to serve adapter self-metrics: %v", err)
+	}
+
+	// restrict what the aggregated apiserver exposes, if configured
+	if err := cmd.restrictAPISurface(); err != nil {
+		glog.Fatalf("unable to restrict API surface: %v", err)
+	}
+
 	// run the server
 	if err := cmd.Run(wait.NeverStop); err != nil {
 		glog.Fatalf("unable to run custom metrics adapter: %v", err)
 	}
 }
 
-// makeKubeconfigHTTPClient constructs an HTTP for connecting with the given auth options.
-func makeKubeconfigHTTPClient(inClusterAuth bool, kubeConfigPath string) (*http.Client, error) {
+// makeKubeconfigRoundTripper constructs the http.RoundTripper for connecting
+// to Prometheus with the given kubeconfig auth options. If override is
+// non-nil, it's installed as the kubeconfig's base Transport before calling
+// rest.TransportFor, so the auth wrappers rest.TransportFor layers on top
+// (bearer token, exec, etc.) end up wrapping override instead of a transport
+// built from the kubeconfig's own TLS settings. Those settings describe how
+// to reach the apiserver the kubeconfig is for, not Prometheus, so the
+// kubeconfig's TLSClientConfig is cleared whenever override is supplied
+// rather than silently combined with it.
+func makeKubeconfigRoundTripper(inClusterAuth bool, kubeConfigPath string, override http.RoundTripper) (http.RoundTripper, error) {
 	// make sure we're not trying to use two different sources of auth
 	if inClusterAuth && kubeConfigPath != "" {
 		return nil, fmt.Errorf("may not use both in-cluster auth and an explicit kubeconfig at the same time")
 	}
 
-	// return the default client if we're using no auth
+	// fall back to the override (or a plain transport) if we're using no kubeconfig auth
 	if !inClusterAuth && kubeConfigPath == "" {
-		return http.DefaultClient, nil
+		if override != nil {
+			return override, nil
+		}
+		return http.DefaultTransport, nil
 	}
 
 	var authConf *rest.Config
@@ -263,31 +419,13 @@ func makeKubeconfigHTTPClient(inClusterAuth bool, kubeConfigPath string) (*http.
 			return nil, fmt.Errorf("unable to construct in-cluster auth configuration for connecting to Prometheus: %v", err)
 		}
 	}
+	if override != nil {
+		authConf.TLSClientConfig = rest.TLSClientConfig{}
+		authConf.Transport = override
+	}
 	tr, err := rest.TransportFor(authConf)
 	if err != nil {
 		return nil, fmt.Errorf("unable to construct client transport for connecting to Prometheus: %v", err)
 	}
-	return &http.Client{Transport: tr}, nil
-}
-
-func makePrometheusCAClient(caFilename string) (*http.Client, error) {
-	pool, err := x509.SystemCertPool()
-	if err != nil {
-		return nil, fmt.Errorf("failed to read system certificates: %v", err)
-	}
-	data, err := ioutil.ReadFile(caFilename)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read prometheus-ca-file: %v", err)
-	}
-	if !pool.AppendCertsFromPEM(data) {
-		log.Printf("warning: no certs found in prometheus-ca-file")
-	}
-
-	return &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				RootCAs: pool,
-			},
-		},
-	}, nil
+	return tr, nil
 }
@@ -0,0 +1,126 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	prom "github.com/directxman12/k8s-prometheus-adapter/pkg/client"
+)
+
+var (
+	seriesDiscovered = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "prometheus_metrics_adapter",
+		Subsystem: "discovery",
+		Name:      "series_discovered",
+		Help:      "Number of series returned by the most recent metrics-relist Series() call.",
+	})
+	relistCacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "prometheus_metrics_adapter",
+		Subsystem: "discovery",
+		Name:      "relist_cache_hits_total",
+		Help:      "Count of metrics-relist Series() calls served from the short-lived in-memory cache.",
+	})
+	relistCacheMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "prometheus_metrics_adapter",
+		Subsystem: "discovery",
+		Name:      "relist_cache_misses_total",
+		Help:      "Count of metrics-relist Series() calls that queried the metrics backend directly.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(seriesDiscovered, relistCacheHits, relistCacheMisses)
+}
+
+// relistCacheTTL picks a cache window shorter than the relist interval
+// itself, so the cache only absorbs calls that land close together (e.g. a
+// manual reload racing the next scheduled relist), not successive relist
+// cycles.
+func relistCacheTTL(relistInterval time.Duration) time.Duration {
+	if relistInterval <= 0 {
+		return 0
+	}
+	return relistInterval / 4
+}
+
+// relistInstrumentedClient wraps a MetricsBackend's Series calls -- the ones
+// the custom-metrics relist loop uses to discover available series -- with a
+// short-lived cache, a gauge of how many series the most recent call found,
+// and a one-shot callback fired the first time a Series call completes
+// without error, which is the signal that a relist cycle has actually run.
+type relistInstrumentedClient struct {
+	prom.Client
+
+	ttl time.Duration
+
+	mu       sync.Mutex
+	cacheKey string
+	cachedAt time.Time
+	cached   []prom.Series
+
+	onFirstSuccess func()
+	signaledOnce   sync.Once
+}
+
+func newRelistInstrumentedClient(client prom.Client, ttl time.Duration, onFirstSuccess func()) prom.Client {
+	return &relistInstrumentedClient{Client: client, ttl: ttl, onFirstSuccess: onFirstSuccess}
+}
+
+func (c *relistInstrumentedClient) Series(ctx context.Context, interval prom.Interval, selectors ...prom.Selector) ([]prom.Series, error) {
+	key := seriesCacheKey(interval, selectors)
+
+	c.mu.Lock()
+	if c.ttl > 0 && key == c.cacheKey && time.Since(c.cachedAt) < c.ttl {
+		cached := c.cached
+		c.mu.Unlock()
+		relistCacheHits.Inc()
+		return cached, nil
+	}
+	c.mu.Unlock()
+
+	relistCacheMisses.Inc()
+	series, err := c.Client.Series(ctx, interval, selectors...)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.cacheKey = key
+	c.cachedAt = time.Now()
+	c.cached = series
+	c.mu.Unlock()
+
+	seriesDiscovered.Set(float64(len(series)))
+	if c.onFirstSuccess != nil {
+		c.signaledOnce.Do(c.onFirstSuccess)
+	}
+	return series, nil
+}
+
+func seriesCacheKey(interval prom.Interval, selectors []prom.Selector) string {
+	key := fmt.Sprintf("%v", interval)
+	for _, sel := range selectors {
+		key += "|" + string(sel)
+	}
+	return key
+}
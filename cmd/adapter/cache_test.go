@@ -0,0 +1,125 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	prom "github.com/directxman12/k8s-prometheus-adapter/pkg/client"
+)
+
+func TestRelistCacheTTL(t *testing.T) {
+	cases := []struct {
+		interval time.Duration
+		want     time.Duration
+	}{
+		{interval: 0, want: 0},
+		{interval: -time.Second, want: 0},
+		{interval: 40 * time.Second, want: 10 * time.Second},
+	}
+	for _, c := range cases {
+		if got := relistCacheTTL(c.interval); got != c.want {
+			t.Errorf("relistCacheTTL(%v) = %v, want %v", c.interval, got, c.want)
+		}
+	}
+}
+
+// countingSeriesClient is a minimal prom.Client stub that counts Series()
+// calls, so tests can assert on cache hit/miss behavior without depending on
+// the package-level Prometheus metric vars.
+type countingSeriesClient struct {
+	calls  int
+	series []prom.Series
+	err    error
+}
+
+func (c *countingSeriesClient) Series(ctx context.Context, interval prom.Interval, selectors ...prom.Selector) ([]prom.Series, error) {
+	c.calls++
+	return c.series, c.err
+}
+
+func (c *countingSeriesClient) Query(ctx context.Context, t prom.Time, query prom.Selector) (prom.QueryResult, error) {
+	return prom.QueryResult{}, nil
+}
+
+func TestRelistInstrumentedClientCachesWithinTTL(t *testing.T) {
+	backend := &countingSeriesClient{series: []prom.Series{{Labels: nil}}}
+	client := newRelistInstrumentedClient(backend, time.Minute, nil)
+
+	if _, err := client.Series(context.Background(), prom.Interval{}); err != nil {
+		t.Fatalf("first Series() call returned error: %v", err)
+	}
+	if _, err := client.Series(context.Background(), prom.Interval{}); err != nil {
+		t.Fatalf("second Series() call returned error: %v", err)
+	}
+	if backend.calls != 1 {
+		t.Errorf("expected the second call to be served from cache, but backend.Series was called %d times", backend.calls)
+	}
+}
+
+func TestRelistInstrumentedClientMissesOnDifferentKey(t *testing.T) {
+	backend := &countingSeriesClient{series: []prom.Series{{Labels: nil}}}
+	client := newRelistInstrumentedClient(backend, time.Minute, nil)
+
+	if _, err := client.Series(context.Background(), prom.Interval{}, prom.Selector("a")); err != nil {
+		t.Fatalf("first Series() call returned error: %v", err)
+	}
+	if _, err := client.Series(context.Background(), prom.Interval{}, prom.Selector("b")); err != nil {
+		t.Fatalf("second Series() call returned error: %v", err)
+	}
+	if backend.calls != 2 {
+		t.Errorf("expected a different selector to bypass the cache, but backend.Series was called %d times", backend.calls)
+	}
+}
+
+func TestRelistInstrumentedClientZeroTTLNeverCaches(t *testing.T) {
+	backend := &countingSeriesClient{series: []prom.Series{{Labels: nil}}}
+	client := newRelistInstrumentedClient(backend, 0, nil)
+
+	client.Series(context.Background(), prom.Interval{})
+	client.Series(context.Background(), prom.Interval{})
+	if backend.calls != 2 {
+		t.Errorf("expected a zero TTL to disable caching entirely, but backend.Series was called %d times, want 2", backend.calls)
+	}
+}
+
+func TestRelistInstrumentedClientOnFirstSuccessFiresOnce(t *testing.T) {
+	backend := &countingSeriesClient{series: []prom.Series{{Labels: nil}}}
+	fires := 0
+	client := newRelistInstrumentedClient(backend, 0, func() { fires++ })
+
+	client.Series(context.Background(), prom.Interval{})
+	client.Series(context.Background(), prom.Interval{})
+	if fires != 1 {
+		t.Errorf("onFirstSuccess fired %d times, want exactly 1", fires)
+	}
+}
+
+func TestRelistInstrumentedClientOnFirstSuccessSkipsOnError(t *testing.T) {
+	backend := &countingSeriesClient{err: context.DeadlineExceeded}
+	fires := 0
+	client := newRelistInstrumentedClient(backend, 0, func() { fires++ })
+
+	if _, err := client.Series(context.Background(), prom.Interval{}); err == nil {
+		t.Fatalf("expected Series() to propagate the backend error")
+	}
+	if fires != 0 {
+		t.Errorf("onFirstSuccess fired %d times on a failed call, want 0", fires)
+	}
+}
@@ -0,0 +1,381 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+
+	prom "github.com/directxman12/k8s-prometheus-adapter/pkg/client"
+	mprom "github.com/directxman12/k8s-prometheus-adapter/pkg/client/metrics"
+)
+
+// PrometheusEndpoint describes one upstream Prometheus (or Thanos/Cortex query
+// frontend) that participates in a federated adapter configuration.
+type PrometheusEndpoint struct {
+	// Name identifies the endpoint in logs, metrics labels, and error messages.
+	Name string `yaml:"name"`
+	// URL is the base URL for this endpoint, in the same form as --prometheus-url.
+	URL string `yaml:"url"`
+	// ClusterLabel, if set, means this endpoint is skipped for series and
+	// queries whose selector carries a different value for ClusterLabelName.
+	// It is still queried when the selector carries no such value, or when no
+	// endpoint's ClusterLabel matches it. If empty, the endpoint participates
+	// in every fan-out query.
+	ClusterLabel string `yaml:"clusterLabel,omitempty"`
+	// Timeout bounds how long a single request to this endpoint may take before
+	// it is dropped from the merged result rather than stalling the whole
+	// query. Unset or non-positive falls back to defaultEndpointTimeout, so an
+	// omitted value still bounds the wait instead of leaving it unbounded.
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+
+	// CAFile, ClientCertFile, ClientKeyFile, and InsecureSkipVerify override the
+	// adapter's global --prometheus-ca-file/--prometheus-client-cert/
+	// --prometheus-client-key/--prometheus-insecure-skip-verify settings for
+	// this endpoint only. Any left unset fall back to the global flag, so a
+	// federation config only needs to set the ones that actually differ
+	// per-cluster.
+	CAFile             string `yaml:"caFile,omitempty"`
+	ClientCertFile     string `yaml:"clientCertFile,omitempty"`
+	ClientKeyFile      string `yaml:"clientKeyFile,omitempty"`
+	InsecureSkipVerify bool   `yaml:"insecureSkipVerify,omitempty"`
+	// TokenFile overrides the adapter's global --prometheus-token-file bearer
+	// token for this endpoint only, falling back to the global flag if unset.
+	TokenFile string `yaml:"tokenFile,omitempty"`
+}
+
+// firstNonEmpty returns the first non-empty string in values, or "" if all
+// are empty. Used to resolve a per-endpoint auth override against the
+// adapter's global --prometheus-* flag of the same kind.
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// defaultEndpointTimeout bounds a federated endpoint's per-request timeout
+// when its config omits Timeout, so a hung shard can't stall a relist or HPA
+// query indefinitely even when the caller's context has no deadline of its
+// own (e.g. the relist loop's background context).
+const defaultEndpointTimeout = 10 * time.Second
+
+// endpointTimeout resolves the effective per-request timeout for ep.
+func endpointTimeout(ep PrometheusEndpoint) time.Duration {
+	if ep.Timeout <= 0 {
+		return defaultEndpointTimeout
+	}
+	return ep.Timeout
+}
+
+// FederatedEndpointsConfig is the schema parsed from --prometheus-federation-config.
+type FederatedEndpointsConfig struct {
+	// ClusterLabelName is the label (e.g. "cluster") used to route queries to
+	// the endpoint whose ClusterLabel matches a value extracted from the
+	// object's namespace or labels. Endpoints without a ClusterLabel are
+	// always queried in addition to any label-matched endpoint.
+	ClusterLabelName string               `yaml:"clusterLabelName,omitempty"`
+	Endpoints        []PrometheusEndpoint `yaml:"endpoints"`
+}
+
+// loadFederatedEndpointsConfig reads and validates a federation config file.
+func loadFederatedEndpointsConfig(path string) (*FederatedEndpointsConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read prometheus-federation-config: %v", err)
+	}
+	cfg := new(FederatedEndpointsConfig)
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("unable to parse prometheus-federation-config: %v", err)
+	}
+	if len(cfg.Endpoints) == 0 {
+		return nil, fmt.Errorf("prometheus-federation-config must list at least one endpoint")
+	}
+	for i, ep := range cfg.Endpoints {
+		if ep.URL == "" {
+			return nil, fmt.Errorf("endpoint %d is missing a url", i)
+		}
+		if ep.Name == "" {
+			cfg.Endpoints[i].Name = ep.URL
+		}
+	}
+	return cfg, nil
+}
+
+// endpointBreaker is a minimal circuit breaker guarding one federated
+// endpoint: once a window of consecutive failures trips the breaker, callers
+// skip the endpoint for a cooldown period instead of waiting out its timeout
+// on every query.
+type endpointBreaker struct {
+	maxFailures int
+	cooldown    time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+}
+
+func newEndpointBreaker(maxFailures int, cooldown time.Duration) *endpointBreaker {
+	return &endpointBreaker{maxFailures: maxFailures, cooldown: cooldown}
+}
+
+func (b *endpointBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return time.Now().After(b.openUntil)
+}
+
+func (b *endpointBreaker) recordResult(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		b.failures = 0
+		b.openUntil = time.Time{}
+		return
+	}
+	b.failures++
+	if b.failures >= b.maxFailures {
+		b.openUntil = time.Now().Add(b.cooldown)
+	}
+}
+
+// federatedMember pairs one upstream prom.Client with the endpoint metadata
+// and per-endpoint circuit breaker used to isolate it from its siblings.
+type federatedMember struct {
+	PrometheusEndpoint
+	client  prom.Client
+	breaker *endpointBreaker
+}
+
+// FederatedClient implements prom.Client by fanning a request out across
+// several upstream Prometheus-compatible endpoints and merging the results,
+// so one adapter can serve HPA metrics for a multi-cluster/federated setup
+// instead of requiring one adapter per Prometheus.
+type FederatedClient struct {
+	clusterLabelName string
+	members          []*federatedMember
+}
+
+// NewFederatedClient builds the per-endpoint HTTP clients described by cfg and
+// returns a prom.Client that fans out across all of them. buildTransport is
+// called once per endpoint so each can reuse the adapter's normal mTLS/bearer
+// token/in-cluster transport chain.
+func NewFederatedClient(cfg *FederatedEndpointsConfig, buildTransport func(PrometheusEndpoint) (http.RoundTripper, error)) (*FederatedClient, error) {
+	fc := &FederatedClient{clusterLabelName: cfg.ClusterLabelName}
+	for _, ep := range cfg.Endpoints {
+		baseURL, err := url.Parse(ep.URL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid url for endpoint %q: %v", ep.Name, err)
+		}
+		transport, err := buildTransport(ep)
+		if err != nil {
+			return nil, fmt.Errorf("unable to build transport for endpoint %q: %v", ep.Name, err)
+		}
+		httpClient := &http.Client{Transport: transport, Timeout: endpointTimeout(ep)}
+		genericClient := prom.NewGenericAPIClient(httpClient, baseURL)
+		instrumentedClient := mprom.InstrumentGenericAPIClient(genericClient, ep.Name)
+		fc.members = append(fc.members, &federatedMember{
+			PrometheusEndpoint: ep,
+			client:             prom.NewClientForAPI(instrumentedClient),
+			breaker:            newEndpointBreaker(3, 30*time.Second),
+		})
+	}
+	return fc, nil
+}
+
+// membersFor returns the federation members eligible for selectors: any
+// endpoint with no ClusterLabel (always queried) plus any endpoint whose
+// ClusterLabel matches the value carried by one of the given selectors for
+// ClusterLabelName. All members are returned when ClusterLabelName is unset,
+// when no selector carries a value for it, or when nothing matches.
+func (c *FederatedClient) membersFor(selectors []prom.Selector) []*federatedMember {
+	if c.clusterLabelName == "" {
+		return c.members
+	}
+	cluster := extractLabelValue(selectors, c.clusterLabelName)
+	if cluster == "" {
+		return c.members
+	}
+	var matched []*federatedMember
+	for _, m := range c.members {
+		if m.ClusterLabel == "" || m.ClusterLabel == cluster {
+			matched = append(matched, m)
+		}
+	}
+	if len(matched) == 0 {
+		return c.members
+	}
+	return matched
+}
+
+func extractLabelValue(selectors []prom.Selector, labelName string) string {
+	needle := labelName + "="
+	for _, sel := range selectors {
+		s := string(sel)
+		if idx := indexOfQuoted(s, needle); idx >= 0 {
+			return idx2value(s, idx+len(needle))
+		}
+	}
+	return ""
+}
+
+// indexOfQuoted finds needle in s, returning -1 if absent. It's a small,
+// dependency-free stand-in for a real PromQL label matcher parser, which
+// would be overkill for extracting a single "name=" style routing hint.
+func indexOfQuoted(s, needle string) int {
+	for i := 0; i+len(needle) <= len(s); i++ {
+		if s[i:i+len(needle)] == needle {
+			return i
+		}
+	}
+	return -1
+}
+
+func idx2value(s string, start int) string {
+	if start >= len(s) || s[start] != '"' {
+		return ""
+	}
+	end := start + 1
+	for end < len(s) && s[end] != '"' {
+		end++
+	}
+	if end >= len(s) {
+		return ""
+	}
+	return s[start+1 : end]
+}
+
+// Series implements prom.Client by querying every eligible member in
+// parallel and returning the union of their series, deduplicated by label set.
+func (c *FederatedClient) Series(ctx context.Context, interval prom.Interval, selectors ...prom.Selector) ([]prom.Series, error) {
+	members := c.membersFor(selectors)
+	type result struct {
+		series []prom.Series
+		err    error
+	}
+	results := make([]result, len(members))
+	var wg sync.WaitGroup
+	for i, m := range members {
+		wg.Add(1)
+		go func(i int, m *federatedMember) {
+			defer wg.Done()
+			if !m.breaker.allow() {
+				results[i] = result{err: fmt.Errorf("endpoint %q circuit open", m.Name)}
+				return
+			}
+			series, err := m.client.Series(ctx, interval, selectors...)
+			m.breaker.recordResult(err)
+			results[i] = result{series: series, err: err}
+		}(i, m)
+	}
+	wg.Wait()
+
+	seen := make(map[string]struct{})
+	var merged []prom.Series
+	var lastErr error
+	for i, res := range results {
+		if res.err != nil {
+			glog.Errorf("federated Series query against endpoint %q failed: %v", members[i].Name, res.err)
+			lastErr = res.err
+			continue
+		}
+		for _, s := range res.series {
+			key := model.LabelSet(s.Labels).String()
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = struct{}{}
+			merged = append(merged, s)
+		}
+	}
+	if merged == nil && lastErr != nil {
+		return nil, fmt.Errorf("all federated endpoints failed, last error: %v", lastErr)
+	}
+	return merged, nil
+}
+
+// Query implements prom.Client by querying every eligible member in parallel
+// and merging their vector results, preferring the newest sample when two
+// endpoints report the same series (which happens when a shared metric is
+// scraped redundantly by more than one Prometheus).
+func (c *FederatedClient) Query(ctx context.Context, t prom.Time, query prom.Selector) (prom.QueryResult, error) {
+	members := c.membersFor([]prom.Selector{query})
+	type result struct {
+		res prom.QueryResult
+		err error
+	}
+	results := make([]result, len(members))
+	var wg sync.WaitGroup
+	for i, m := range members {
+		wg.Add(1)
+		go func(i int, m *federatedMember) {
+			defer wg.Done()
+			if !m.breaker.allow() {
+				results[i] = result{err: fmt.Errorf("endpoint %q circuit open", m.Name)}
+				return
+			}
+			res, err := m.client.Query(ctx, t, query)
+			m.breaker.recordResult(err)
+			results[i] = result{res: res, err: err}
+		}(i, m)
+	}
+	wg.Wait()
+
+	merged := make(map[model.Fingerprint]*model.Sample)
+	var lastErr error
+	any := false
+	for i, res := range results {
+		if res.err != nil {
+			glog.Errorf("federated Query against endpoint %q failed: %v", members[i].Name, res.err)
+			lastErr = res.err
+			continue
+		}
+		if res.res.Vector == nil {
+			continue
+		}
+		any = true
+		for _, sample := range *res.res.Vector {
+			fp := sample.Metric.Fingerprint()
+			if existing, ok := merged[fp]; !ok || sample.Timestamp > existing.Timestamp {
+				merged[fp] = sample
+			}
+		}
+	}
+	if !any {
+		if lastErr != nil {
+			return prom.QueryResult{}, fmt.Errorf("all federated endpoints failed, last error: %v", lastErr)
+		}
+		return prom.QueryResult{}, nil
+	}
+
+	vec := make(model.Vector, 0, len(merged))
+	for _, sample := range merged {
+		vec = append(vec, sample)
+	}
+	return prom.QueryResult{Type: model.ValVector, Vector: &vec}, nil
+}
@@ -0,0 +1,151 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+
+	prom "github.com/directxman12/k8s-prometheus-adapter/pkg/client"
+)
+
+func TestEndpointBreakerTripsAfterMaxFailures(t *testing.T) {
+	b := newEndpointBreaker(3, 50*time.Millisecond)
+
+	if !b.allow() {
+		t.Fatalf("expected a fresh breaker to allow requests")
+	}
+
+	b.recordResult(fmt.Errorf("boom"))
+	b.recordResult(fmt.Errorf("boom"))
+	if !b.allow() {
+		t.Fatalf("breaker tripped before reaching maxFailures")
+	}
+
+	b.recordResult(fmt.Errorf("boom"))
+	if b.allow() {
+		t.Fatalf("expected breaker to be open after maxFailures consecutive failures")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if !b.allow() {
+		t.Fatalf("expected breaker to close again once the cooldown elapsed")
+	}
+}
+
+func TestEndpointBreakerResetsOnSuccess(t *testing.T) {
+	b := newEndpointBreaker(2, time.Minute)
+
+	b.recordResult(fmt.Errorf("boom"))
+	b.recordResult(nil)
+	b.recordResult(fmt.Errorf("boom"))
+	if !b.allow() {
+		t.Fatalf("a success should reset the failure count, so one more failure shouldn't trip the breaker")
+	}
+}
+
+func TestEndpointTimeoutDefaultsWhenUnset(t *testing.T) {
+	if got := endpointTimeout(PrometheusEndpoint{}); got != defaultEndpointTimeout {
+		t.Errorf("endpointTimeout() with no Timeout set = %v, want %v", got, defaultEndpointTimeout)
+	}
+	if got := endpointTimeout(PrometheusEndpoint{Timeout: -1}); got != defaultEndpointTimeout {
+		t.Errorf("endpointTimeout() with negative Timeout = %v, want %v", got, defaultEndpointTimeout)
+	}
+	if got := endpointTimeout(PrometheusEndpoint{Timeout: 5 * time.Second}); got != 5*time.Second {
+		t.Errorf("endpointTimeout() with an explicit Timeout = %v, want 5s", got)
+	}
+}
+
+// fakeMemberClient is a minimal prom.Client stub for exercising
+// FederatedClient's fan-out/merge logic without a real HTTP backend.
+type fakeMemberClient struct {
+	series []prom.Series
+	result prom.QueryResult
+	err    error
+}
+
+func (f *fakeMemberClient) Series(ctx context.Context, interval prom.Interval, selectors ...prom.Selector) ([]prom.Series, error) {
+	return f.series, f.err
+}
+
+func (f *fakeMemberClient) Query(ctx context.Context, t prom.Time, query prom.Selector) (prom.QueryResult, error) {
+	return f.result, f.err
+}
+
+func vectorOf(samples ...*model.Sample) *model.Vector {
+	vec := model.Vector(samples)
+	return &vec
+}
+
+func TestFederatedClientQueryPrefersNewestSample(t *testing.T) {
+	metric := model.Metric{"__name__": "http_requests"}
+	older := &model.Sample{Metric: metric, Value: 1, Timestamp: 1000}
+	newer := &model.Sample{Metric: metric, Value: 2, Timestamp: 2000}
+
+	fc := &FederatedClient{
+		members: []*federatedMember{
+			{
+				PrometheusEndpoint: PrometheusEndpoint{Name: "stale"},
+				client:             &fakeMemberClient{result: prom.QueryResult{Type: model.ValVector, Vector: vectorOf(older)}},
+				breaker:            newEndpointBreaker(3, time.Minute),
+			},
+			{
+				PrometheusEndpoint: PrometheusEndpoint{Name: "fresh"},
+				client:             &fakeMemberClient{result: prom.QueryResult{Type: model.ValVector, Vector: vectorOf(newer)}},
+				breaker:            newEndpointBreaker(3, time.Minute),
+			},
+		},
+	}
+
+	res, err := fc.Query(context.Background(), prom.Time(0), prom.Selector("http_requests"))
+	if err != nil {
+		t.Fatalf("Query() returned error: %v", err)
+	}
+	if res.Vector == nil || len(*res.Vector) != 1 {
+		t.Fatalf("expected exactly one merged sample, got %+v", res.Vector)
+	}
+	if got := (*res.Vector)[0]; got.Timestamp != newer.Timestamp {
+		t.Errorf("Query() kept sample with timestamp %v, want the newer sample's %v", got.Timestamp, newer.Timestamp)
+	}
+}
+
+func TestFederatedClientQuerySkipsOpenBreakers(t *testing.T) {
+	metric := model.Metric{"__name__": "http_requests"}
+	sample := &model.Sample{Metric: metric, Value: 1, Timestamp: 1000}
+
+	openBreaker := newEndpointBreaker(1, time.Minute)
+	openBreaker.recordResult(fmt.Errorf("boom"))
+
+	fc := &FederatedClient{
+		members: []*federatedMember{
+			{
+				PrometheusEndpoint: PrometheusEndpoint{Name: "down"},
+				client:             &fakeMemberClient{result: prom.QueryResult{Type: model.ValVector, Vector: vectorOf(sample)}},
+				breaker:            openBreaker,
+			},
+		},
+	}
+
+	res, err := fc.Query(context.Background(), prom.Time(0), prom.Selector("http_requests"))
+	if err == nil {
+		t.Fatalf("expected an error when the only member's breaker is open, got result %+v", res)
+	}
+}
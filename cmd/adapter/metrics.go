@@ -0,0 +1,188 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/kubernetes-incubator/custom-metrics-apiserver/pkg/provider"
+	custom_metrics "k8s.io/metrics/pkg/apis/custom_metrics"
+)
+
+var (
+	discoveryDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "prometheus_metrics_adapter",
+		Subsystem: "discovery",
+		Name:      "duration_seconds",
+		Help:      "Time taken to load the discovery config; on a hot reload this also covers rebuilding the custom metrics provider from it.",
+		Buckets:   prometheus.DefBuckets,
+	})
+	discoveryRuleCount = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "prometheus_metrics_adapter",
+		Subsystem: "discovery",
+		Name:      "rules",
+		Help:      "Number of custom metrics discovery rules currently loaded.",
+	})
+	hpaLookupLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "prometheus_metrics_adapter",
+		Subsystem: "custom_metrics",
+		Name:      "lookup_duration_seconds",
+		Help:      "Latency of custom metrics API lookups, by method and group-resource.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "group_resource"})
+	hpaLookupErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "prometheus_metrics_adapter",
+		Subsystem: "custom_metrics",
+		Name:      "lookup_errors_total",
+		Help:      "Count of failed custom metrics API lookups, by method and group-resource.",
+	}, []string{"method", "group_resource"})
+	configReloadErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "prometheus_metrics_adapter",
+		Subsystem: "discovery",
+		Name:      "config_reload_errors_total",
+		Help:      "Count of failed attempts to reload the metrics discovery configuration file.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(discoveryDuration, discoveryRuleCount, hpaLookupLatency, hpaLookupErrors, configReloadErrors)
+}
+
+// instrumentedProvider wraps a provider.CustomMetricsProvider, recording
+// lookup latency and error counts by GroupResource so that HPA query
+// performance and failure rates are visible on the adapter's own /metrics
+// endpoint.
+type instrumentedProvider struct {
+	provider.CustomMetricsProvider
+}
+
+func instrumentProvider(p provider.CustomMetricsProvider) provider.CustomMetricsProvider {
+	if p == nil {
+		return nil
+	}
+	return &instrumentedProvider{CustomMetricsProvider: p}
+}
+
+func (p *instrumentedProvider) GetMetricByName(ctx context.Context, name types.NamespacedName, info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValue, error) {
+	start := time.Now()
+	val, err := p.CustomMetricsProvider.GetMetricByName(ctx, name, info, metricSelector)
+	observeLookup("GetMetricByName", info.GroupResource.String(), start, err)
+	return val, err
+}
+
+func (p *instrumentedProvider) GetMetricBySelector(ctx context.Context, namespace string, selector labels.Selector, info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValueList, error) {
+	start := time.Now()
+	val, err := p.CustomMetricsProvider.GetMetricBySelector(ctx, namespace, selector, info, metricSelector)
+	observeLookup("GetMetricBySelector", info.GroupResource.String(), start, err)
+	return val, err
+}
+
+func observeLookup(method, groupResource string, start time.Time, err error) {
+	hpaLookupLatency.WithLabelValues(method, groupResource).Observe(time.Since(start).Seconds())
+	if err != nil {
+		hpaLookupErrors.WithLabelValues(method, groupResource).Inc()
+	}
+}
+
+// serveSelfMetrics starts a dedicated HTTP listener, separate from the
+// aggregated apiserver, exposing this process's own Prometheus metrics
+// (registered above, plus the adapter->Prometheus request instrumentation
+// from mprom.InstrumentGenericAPIClient). It uses its own TLS materials, not
+// the Prometheus client's: --metrics-tls-cert-file/--metrics-tls-key-file
+// serve over TLS, and --metrics-client-ca-file requires scrapers to present a
+// client certificate signed by that CA. Bearer tokens are not checked.
+func (cmd *PrometheusAdapter) serveSelfMetrics(stopCh <-chan struct{}) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	server := &http.Server{
+		Addr:    cmd.MetricsBindAddress,
+		Handler: mux,
+	}
+
+	if cmd.MetricsTLSCertFile != "" || cmd.MetricsClientCAFile != "" {
+		tlsConfig, err := buildServerTLSConfig(cmd.MetricsTLSCertFile, cmd.MetricsTLSKeyFile, cmd.MetricsClientCAFile)
+		if err != nil {
+			return err
+		}
+		server.TLSConfig = tlsConfig
+	}
+
+	go func() {
+		<-stopCh
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = server.Shutdown(ctx)
+	}()
+
+	go func() {
+		var err error
+		if server.TLSConfig != nil {
+			err = server.ListenAndServeTLS(cmd.MetricsTLSCertFile, cmd.MetricsTLSKeyFile)
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			glog.Fatalf("unable to serve adapter self-metrics on %s: %v", cmd.MetricsBindAddress, err)
+		}
+	}()
+
+	glog.Infof("serving adapter self-metrics on %s", cmd.MetricsBindAddress)
+	return nil
+}
+
+// buildServerTLSConfig configures the metrics listener's server certificate
+// and, if a client CA is given, requires and verifies client certificates so
+// the metrics endpoint can be scraped over mutual TLS.
+func buildServerTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load metrics-tls-cert-file/metrics-tls-key-file: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if clientCAFile != "" {
+		pool := x509.NewCertPool()
+		data, err := ioutil.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read metrics-client-ca-file: %v", err)
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certs found in metrics-client-ca-file %q", clientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, nil
+}
@@ -0,0 +1,110 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/common/model"
+	"k8s.io/apiserver/pkg/server/healthz"
+
+	prom "github.com/directxman12/k8s-prometheus-adapter/pkg/client"
+)
+
+// nowModelTime converts the current wall-clock time into the prom.Time used
+// by prom.Client.Query, for the "up" reachability probe below.
+func nowModelTime() prom.Time {
+	return prom.Time(model.TimeFromUnixNano(time.Now().UnixNano()))
+}
+
+// readinessGates tracks the three preconditions HPA lookups depend on:
+// the discovery config loaded, Prometheus answered an initial probe, and the
+// custom metrics provider has completed at least one relist cycle. Each gate
+// is exposed as its own named /readyz sub-check so kubelet probes and
+// operators can tell which stage is stuck.
+//
+// markRelisted is driven directly by relistInstrumentedClient's
+// onFirstSuccess callback (cache.go), i.e. the first time the relist loop's
+// own Series() call completes without error -- not by inferring completion
+// from the resulting metric count, which would stay unready forever for a
+// valid config whose rules simply match zero series so far.
+type readinessGates struct {
+	configLoaded        int32
+	prometheusReachable int32
+	relisted            int32
+}
+
+func (g *readinessGates) markConfigLoaded()        { atomic.StoreInt32(&g.configLoaded, 1) }
+func (g *readinessGates) markPrometheusReachable() { atomic.StoreInt32(&g.prometheusReachable, 1) }
+func (g *readinessGates) markRelisted()            { atomic.StoreInt32(&g.relisted, 1) }
+
+func (g *readinessGates) checks() []healthz.HealthChecker {
+	named := func(name string, flag *int32) healthz.HealthChecker {
+		return healthz.NamedCheck(name, func(r *http.Request) error {
+			if atomic.LoadInt32(flag) == 0 {
+				return fmt.Errorf("%s has not completed yet", name)
+			}
+			return nil
+		})
+	}
+	return []healthz.HealthChecker{
+		named("config-loaded", &g.configLoaded),
+		named("prometheus-reachable", &g.prometheusReachable),
+		named("metrics-relisted", &g.relisted),
+	}
+}
+
+// registerReadyzChecks wires the readiness gates into the aggregated
+// apiserver's /readyz endpoint.
+func (cmd *PrometheusAdapter) registerReadyzChecks(g *readinessGates) error {
+	server, err := cmd.Server()
+	if err != nil {
+		return err
+	}
+	return server.GenericAPIServer.AddReadyzChecks(g.checks()...)
+}
+
+// probePrometheusReachable blocks until promClient answers a basic "up"
+// query, retrying with a short backoff, and fails fast with glog.Fatalf if
+// --prometheus-startup-timeout elapses first rather than looping forever
+// against an unreachable Prometheus.
+func (cmd *PrometheusAdapter) probePrometheusReachable(promClient prom.Client, g *readinessGates) {
+	deadline := time.Now().Add(cmd.PrometheusStartupTimeout)
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		_, err := promClient.Query(ctx, nowModelTime(), prom.Selector("up"))
+		cancel()
+		if err == nil {
+			g.markPrometheusReachable()
+			return
+		}
+		glog.Warningf("prometheus startup probe failed, will retry: %v", err)
+
+		if cmd.PrometheusStartupTimeout > 0 && time.Now().After(deadline) {
+			glog.Fatalf("prometheus was not reachable within --prometheus-startup-timeout (%s): %v", cmd.PrometheusStartupTimeout, err)
+		}
+		<-ticker.C
+	}
+}
@@ -0,0 +1,176 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	custom_metrics "k8s.io/metrics/pkg/apis/custom_metrics"
+
+	"github.com/kubernetes-incubator/custom-metrics-apiserver/pkg/provider"
+
+	prom "github.com/directxman12/k8s-prometheus-adapter/pkg/client"
+	adaptercfg "github.com/directxman12/k8s-prometheus-adapter/pkg/config"
+)
+
+// reloadingProvider is a provider.CustomMetricsProvider facade whose backing
+// provider can be swapped atomically, so reloading the discovery config takes
+// effect without restarting the adapter or dropping in-flight requests. It
+// also owns the stop channel for the relist goroutine backing the current
+// provider, so swapping in a replacement stops the outgoing one instead of
+// leaking it.
+type reloadingProvider struct {
+	mu        sync.RWMutex
+	current   provider.CustomMetricsProvider
+	buildStop chan struct{}
+}
+
+func newReloadingProvider(initial provider.CustomMetricsProvider, initialStop chan struct{}) *reloadingProvider {
+	return &reloadingProvider{current: initial, buildStop: initialStop}
+}
+
+// swap installs next as the live provider, backed by nextStop, and stops the
+// relist goroutine of whatever provider was live before it.
+func (p *reloadingProvider) swap(next provider.CustomMetricsProvider, nextStop chan struct{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.buildStop != nil {
+		close(p.buildStop)
+	}
+	p.current = next
+	p.buildStop = nextStop
+}
+
+func (p *reloadingProvider) get() provider.CustomMetricsProvider {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.current
+}
+
+func (p *reloadingProvider) GetMetricByName(ctx context.Context, name types.NamespacedName, info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValue, error) {
+	cur := p.get()
+	if cur == nil {
+		return nil, fmt.Errorf("no custom metrics are currently configured")
+	}
+	return cur.GetMetricByName(ctx, name, info, metricSelector)
+}
+
+func (p *reloadingProvider) GetMetricBySelector(ctx context.Context, namespace string, selector labels.Selector, info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValueList, error) {
+	cur := p.get()
+	if cur == nil {
+		return nil, fmt.Errorf("no custom metrics are currently configured")
+	}
+	return cur.GetMetricBySelector(ctx, namespace, selector, info, metricSelector)
+}
+
+func (p *reloadingProvider) ListAllMetrics() []provider.CustomMetricInfo {
+	cur := p.get()
+	if cur == nil {
+		return nil
+	}
+	return cur.ListAllMetrics()
+}
+
+// watchConfigReload watches cmd.AdapterConfigFile for changes and reloads it
+// into rp when they're seen, either via SIGHUP (immediate, unconditional) or
+// via polling its mtime every ConfigReloadInterval (the debounce: a tick that
+// sees no mtime change is a no-op). This repo doesn't vendor an fsnotify
+// client, so the mtime poll is the only change-detection mechanism rather
+// than a true inotify/kqueue watch; ConfigReloadInterval <= 0 disables it and
+// leaves SIGHUP as the only way to reload.
+func (cmd *PrometheusAdapter) watchConfigReload(promClient prom.Client, rp *reloadingProvider, stopCh <-chan struct{}) {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	defer signal.Stop(sighup)
+
+	var ticker *time.Ticker
+	var tickerC <-chan time.Time
+	if cmd.ConfigReloadInterval > 0 {
+		ticker = time.NewTicker(cmd.ConfigReloadInterval)
+		tickerC = ticker.C
+		defer ticker.Stop()
+	}
+
+	lastModTime := statModTime(cmd.AdapterConfigFile)
+
+	for {
+		select {
+		case <-tickerC:
+			modTime := statModTime(cmd.AdapterConfigFile)
+			if modTime.Equal(lastModTime) {
+				continue
+			}
+			lastModTime = modTime
+			cmd.reloadConfig(promClient, rp)
+		case <-sighup:
+			glog.Infof("received SIGHUP, reloading metrics discovery configuration")
+			cmd.reloadConfig(promClient, rp)
+			lastModTime = statModTime(cmd.AdapterConfigFile)
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+func statModTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		glog.Errorf("unable to stat %s for config reload: %v", path, err)
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+func (cmd *PrometheusAdapter) reloadConfig(promClient prom.Client, rp *reloadingProvider) {
+	start := time.Now()
+
+	newConfig, err := adaptercfg.FromFile(cmd.AdapterConfigFile)
+	if err != nil {
+		glog.Errorf("unable to reload metrics discovery configuration, keeping previous config: %v", err)
+		configReloadErrors.Inc()
+		return
+	}
+
+	newStop := make(chan struct{})
+	newProvider, err := cmd.makeProviderForConfig(newConfig, promClient, newStop)
+	if err != nil {
+		close(newStop)
+		glog.Errorf("unable to rebuild custom metrics provider from reloaded configuration, keeping previous config: %v", err)
+		configReloadErrors.Inc()
+		return
+	}
+	if newProvider == nil {
+		// no rules in the new config, so makeProviderForConfig never started a relist goroutine
+		close(newStop)
+		newStop = nil
+	}
+
+	cmd.metricsConfig = newConfig
+	rp.swap(newProvider, newStop)
+	discoveryDuration.Observe(time.Since(start).Seconds())
+	discoveryRuleCount.Set(float64(len(newConfig.Rules)))
+	glog.Infof("reloaded metrics discovery configuration from %s", cmd.AdapterConfigFile)
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	custom_metrics "k8s.io/metrics/pkg/apis/custom_metrics"
+
+	"github.com/kubernetes-incubator/custom-metrics-apiserver/pkg/provider"
+)
+
+// fakeMetricsProvider is a minimal provider.CustomMetricsProvider stub used
+// to exercise reloadingProvider's swap/get bookkeeping without a real relist
+// loop behind it.
+type fakeMetricsProvider struct {
+	name string
+}
+
+func (f *fakeMetricsProvider) GetMetricByName(ctx context.Context, name types.NamespacedName, info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValue, error) {
+	return nil, nil
+}
+
+func (f *fakeMetricsProvider) GetMetricBySelector(ctx context.Context, namespace string, selector labels.Selector, info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValueList, error) {
+	return nil, nil
+}
+
+func (f *fakeMetricsProvider) ListAllMetrics() []provider.CustomMetricInfo {
+	return nil
+}
+
+func TestReloadingProviderSwapClosesPreviousStopChannel(t *testing.T) {
+	firstStop := make(chan struct{})
+	rp := newReloadingProvider(&fakeMetricsProvider{name: "first"}, firstStop)
+
+	rp.swap(&fakeMetricsProvider{name: "second"}, make(chan struct{}))
+
+	select {
+	case <-firstStop:
+	default:
+		t.Fatalf("swap did not close the outgoing provider's stop channel")
+	}
+}
+
+func TestReloadingProviderSwapFromNilStopChannel(t *testing.T) {
+	rp := newReloadingProvider(nil, nil)
+
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				t.Fatalf("swap panicked with a nil initial stop channel: %v", r)
+			}
+		}()
+		rp.swap(&fakeMetricsProvider{name: "second"}, make(chan struct{}))
+	}()
+
+	if rp.get() == nil {
+		t.Fatalf("expected the new provider to be live after swap")
+	}
+}
+
+func TestReloadingProviderSwapToNilStopChannel(t *testing.T) {
+	rp := newReloadingProvider(&fakeMetricsProvider{name: "first"}, make(chan struct{}))
+
+	rp.swap(nil, nil)
+	if rp.get() != nil {
+		t.Fatalf("expected get() to return nil after swapping in a nil provider")
+	}
+
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				t.Fatalf("a second swap panicked after a prior swap left a nil stop channel: %v", r)
+			}
+		}()
+		rp.swap(&fakeMetricsProvider{name: "second"}, make(chan struct{}))
+	}()
+}
+
+func TestReloadingProviderMethodsErrorWithNoProvider(t *testing.T) {
+	rp := newReloadingProvider(nil, nil)
+
+	if _, err := rp.GetMetricByName(context.Background(), types.NamespacedName{}, provider.CustomMetricInfo{}, labels.Everything()); err == nil {
+		t.Errorf("expected GetMetricByName to error when no provider is configured")
+	}
+	if _, err := rp.GetMetricBySelector(context.Background(), "default", labels.Everything(), provider.CustomMetricInfo{}, labels.Everything()); err == nil {
+		t.Errorf("expected GetMetricBySelector to error when no provider is configured")
+	}
+	if got := rp.ListAllMetrics(); got != nil {
+		t.Errorf("expected ListAllMetrics to return nil when no provider is configured, got %v", got)
+	}
+}
+
+func TestStatModTimeMissingFileReturnsZero(t *testing.T) {
+	if got := statModTime("/nonexistent/path/does-not-exist.yaml"); !got.IsZero() {
+		t.Errorf("statModTime() for a missing file = %v, want the zero time", got)
+	}
+}
+
+func TestStatModTimeRealFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "reload-test-*.yaml")
+	if err != nil {
+		t.Fatalf("unable to create temp file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	f.Close()
+
+	before := time.Now().Add(-time.Second)
+	if got := statModTime(f.Name()); got.Before(before) {
+		t.Errorf("statModTime() = %v, want a time after %v", got, before)
+	}
+}
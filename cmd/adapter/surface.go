@@ -0,0 +1,75 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// restrictAPISurface installs a filter in front of the aggregated apiserver's
+// handler chain that drops requests for routes the operator has opted out of
+// (--disable-openapi, --disable-profiling) and, if an allowlist is set, 404s
+// any path that isn't under one of its prefixes. This mirrors the pattern
+// already used for exposed Prometheus routes: reduce what's reachable when
+// the adapter is proxied through an ingress, rather than trusting the
+// generic apiserver's default surface.
+func (cmd *PrometheusAdapter) restrictAPISurface() error {
+	if !cmd.DisableOpenAPI && !cmd.DisableProfiling && len(cmd.AllowedURLPrefixes) == 0 {
+		return nil
+	}
+
+	server, err := cmd.Server()
+	if err != nil {
+		return err
+	}
+
+	chain := server.GenericAPIServer.Handler.FullHandlerChain
+	server.GenericAPIServer.Handler.FullHandlerChain = newSurfaceFilterHandler(
+		cmd.DisableOpenAPI, cmd.DisableProfiling, cmd.AllowedURLPrefixes, chain)
+	return nil
+}
+
+func newSurfaceFilterHandler(disableOpenAPI, disableProfiling bool, allowedPrefixes []string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		path := req.URL.Path
+
+		if disableOpenAPI && (strings.HasPrefix(path, "/openapi") || strings.HasPrefix(path, "/swagger")) {
+			http.NotFound(w, req)
+			return
+		}
+		if disableProfiling && strings.HasPrefix(path, "/debug") {
+			http.NotFound(w, req)
+			return
+		}
+		if len(allowedPrefixes) > 0 && !hasAnyPrefix(path, allowedPrefixes) {
+			http.NotFound(w, req)
+			return
+		}
+
+		next.ServeHTTP(w, req)
+	})
+}
+
+func hasAnyPrefix(path string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
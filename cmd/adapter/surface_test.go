@@ -0,0 +1,90 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewSurfaceFilterHandlerDefaultAllowsEverything(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) })
+	handler := newSurfaceFilterHandler(false, false, nil, next)
+
+	for _, path := range []string{"/openapi/v2", "/debug/pprof/", "/apis/custom.metrics.k8s.io/v1beta1"} {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+		if rr.Code != http.StatusOK {
+			t.Errorf("path %q: got status %d with no flags set, want %d (unrestricted by default)", path, rr.Code, http.StatusOK)
+		}
+	}
+}
+
+func TestNewSurfaceFilterHandlerDisableOpenAPI(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) })
+	handler := newSurfaceFilterHandler(true, false, nil, next)
+
+	for _, path := range []string{"/openapi/v2", "/swagger.json"} {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("path %q: got status %d with disableOpenAPI, want 404", path, rr.Code)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/apis/custom.metrics.k8s.io/v1beta1", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("unrelated path got status %d with disableOpenAPI, want 200", rr.Code)
+	}
+}
+
+func TestNewSurfaceFilterHandlerDisableProfiling(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) })
+	handler := newSurfaceFilterHandler(false, true, nil, next)
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/debug/pprof/heap", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("got status %d for /debug/pprof/heap with disableProfiling, want 404", rr.Code)
+	}
+}
+
+func TestNewSurfaceFilterHandlerAllowedPrefixes(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) })
+	handler := newSurfaceFilterHandler(false, false, []string{"/apis/custom.metrics.k8s.io"}, next)
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/apis/custom.metrics.k8s.io/v1beta1", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("allowed path got status %d, want 200", rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/apis/apps.k8s.io/v1", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("path outside the allowlist got status %d, want 404", rr.Code)
+	}
+}
+
+func TestRestrictAPISurfaceSkippedWhenNothingConfigured(t *testing.T) {
+	cmd := &PrometheusAdapter{}
+	if err := cmd.restrictAPISurface(); err != nil {
+		t.Fatalf("restrictAPISurface() with no flags set returned error: %v", err)
+	}
+}